@@ -0,0 +1,83 @@
+// audit.go records what reggc deleted (or, in dry-run mode, would have
+// deleted) so deletions are traceable after the fact.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// auditEvent identifies the Kubernetes object that deletion Events are
+// attached to, resolved at startup from the config file. It is nil when
+// the config sets no auditEvent target, in which case deletions are only
+// logged to stdout.
+var auditEvent *AuditEventTarget
+
+// recordDeletion emits an audit record for a single image deletion (or,
+// when dryRun is true, a deletion that was skipped). size is the total
+// size in bytes of the manifest's layers, as reported by the registry, or
+// zero when the manifest is kept because another tag still points at it.
+// The record is written to stdout.
+func recordDeletion(
+	ctx context.Context, reg registry, repo, tag, digest string, size int64, dryRun bool,
+) {
+	reason := "unreferenced"
+	verb := "deleted"
+	if dryRun {
+		verb = "would delete"
+	}
+	audit := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	audit.Info("audit: "+verb+" image",
+		"registry", reg.host, "repo", repo, "tag", tag, "digest", digest,
+		"bytes", size, "reason", reason, "dry_run", dryRun,
+		"time", time.Now().UTC().Format(time.RFC3339))
+
+	dryRunLabel := "false"
+	if dryRun {
+		dryRunLabel = "true"
+	}
+	imagesDeleted.WithLabelValues(reg.host, dryRunLabel).Inc()
+	bytesReclaimed.WithLabelValues(reg.host, dryRunLabel).Add(float64(size))
+
+	if auditEvent == nil {
+		return
+	}
+	if err := emitAuditEvent(ctx, reg, repo, tag, digest, verb); err != nil {
+		slog.Warn("could not emit audit event",
+			"registry", reg.host, "repo", repo, "tag", tag, "err", err)
+	}
+}
+
+// emitAuditEvent records a Kubernetes Event against the configured
+// auditEvent object describing a single image deletion.
+func emitAuditEvent(ctx context.Context, reg registry, repo, tag, digest, verb string) error {
+	now := metav1.NewTime(time.Now())
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "reggc-",
+			Namespace:    auditEvent.Namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			Kind:      auditEvent.Kind,
+			Namespace: auditEvent.Namespace,
+			Name:      auditEvent.Name,
+		},
+		Reason: "ImageDeleted",
+		Message: fmt.Sprintf("reggc %s %s/%s:%s (%s)",
+			verb, reg.host, repo, tag, digest),
+		Type:           corev1.EventTypeNormal,
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Source:         corev1.EventSource{Component: "reggc"},
+	}
+	_, err := k8s.CoreV1().Events(auditEvent.Namespace).Create(
+		ctx, event, metav1.CreateOptions{})
+	return err
+}
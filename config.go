@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/regclient/regclient/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Config describes the registries reggc manages and how to reach them.
+type Config struct {
+	Registries []RegistryConfig `json:"registries"`
+	// AuditEvent, if set, identifies a Kubernetes object that deletion
+	// audit records are additionally recorded against as Events, in
+	// addition to the structured log record every deletion already
+	// produces on stdout.
+	AuditEvent *AuditEventTarget `json:"auditEvent,omitempty"`
+}
+
+// AuditEventTarget identifies the Kubernetes object that reggc's Event
+// records for image deletions are attached to.
+type AuditEventTarget struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`
+}
+
+// RegistryConfig describes a single registry to garbage collect.
+type RegistryConfig struct {
+	// Host is the external hostname that appears in workload image
+	// strings, e.g. "ctr.example.com". Images are grouped by this field
+	// so a reference into one registry never protects an image in
+	// another.
+	Host string `json:"host"`
+	// Endpoint is the registry's address as reached from inside the
+	// cluster, e.g. "registry:5000".
+	Endpoint string `json:"endpoint"`
+	// TLS is one of "enabled", "disabled", or "insecure". Defaults to
+	// "enabled".
+	TLS string `json:"tls,omitempty"`
+
+	Auth *RegistryAuth `json:"auth,omitempty"`
+	// GC selects how this registry is garbage collected once unreferenced
+	// tags have been deleted. One of "api" (default), which relies on
+	// deleteImage's manifest and blob deletes through the registry API, or
+	// "exec", which additionally triggers the offline
+	// distribution/registry sweep via Exec.
+	GC string `json:"gc,omitempty"`
+	// Exec identifies an in-cluster pod used to run the offline
+	// garbage-collect sweep for registries with GC set to "exec".
+	Exec *ExecTarget `json:"exec,omitempty"`
+}
+
+// RegistryAuth configures credentials for a registry. At most one of
+// Basic, Bearer, or DockerConfigSecret should be set.
+type RegistryAuth struct {
+	Basic              *BasicAuth `json:"basic,omitempty"`
+	Bearer             string     `json:"bearer,omitempty"`
+	DockerConfigSecret *SecretRef `json:"dockerConfigSecret,omitempty"`
+}
+
+// BasicAuth is a username and password, the password given inline or read
+// from a Secret.
+type BasicAuth struct {
+	Username       string     `json:"username"`
+	Password       string     `json:"password,omitempty"`
+	PasswordSecret *SecretRef `json:"passwordSecret,omitempty"`
+}
+
+// SecretRef points at a key within a Kubernetes Secret.
+type SecretRef struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Key       string `json:"key,omitempty"`
+}
+
+// ExecTarget identifies an in-cluster pod used to run registry maintenance
+// commands.
+type ExecTarget struct {
+	Namespace string   `json:"namespace"`
+	Pod       string   `json:"pod"`
+	Command   []string `json:"command"`
+}
+
+// loadConfig reads and validates the registry configuration at path.
+func loadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config %q: %w", path, err)
+	}
+	var cfg Config
+	if err := yaml.UnmarshalStrict(b, &cfg); err != nil {
+		return nil, fmt.Errorf("could not parse config %q: %w", path, err)
+	}
+	if len(cfg.Registries) == 0 {
+		return nil, fmt.Errorf("config %q defines no registries", path)
+	}
+	for _, r := range cfg.Registries {
+		if r.Host == "" || r.Endpoint == "" {
+			return nil, fmt.Errorf(
+				"config %q: registries must set both host and endpoint", path)
+		}
+		switch r.GC {
+		case "", "api":
+		case "exec":
+			if r.Exec == nil {
+				return nil, fmt.Errorf(
+					"config %q: registry %q: gc: exec requires exec",
+					path, r.Host)
+			}
+		default:
+			return nil, fmt.Errorf(
+				"config %q: registry %q: unknown gc mode %q",
+				path, r.Host, r.GC)
+		}
+	}
+	if ae := cfg.AuditEvent; ae != nil {
+		if ae.Namespace == "" || ae.Name == "" || ae.Kind == "" {
+			return nil, fmt.Errorf(
+				"config %q: auditEvent must set namespace, name, and kind", path)
+		}
+	}
+	return &cfg, nil
+}
+
+// registry is a registry target resolved from config, ready to be used by
+// fetchRegistryImages, deleteImage, and gcRegistry.
+type registry struct {
+	host     string
+	endpoint string
+	gc       string
+	exec     *ExecTarget
+}
+
+// resolveRegistries turns cfg's registries into regclient hosts, reading
+// any credentials the config points at from Kubernetes Secrets.
+func resolveRegistries(ctx context.Context, cfg *Config) ([]registry, []config.Host, error) {
+	var regs []registry
+	var hosts []config.Host
+	for _, rc := range cfg.Registries {
+		tls, err := parseTLS(rc.TLS)
+		if err != nil {
+			return nil, nil, fmt.Errorf("registry %q: %w", rc.Host, err)
+		}
+		host := config.Host{Name: rc.Endpoint, TLS: tls}
+		if rc.Auth != nil {
+			if err := applyAuth(ctx, &host, rc.Host, rc.Auth); err != nil {
+				return nil, nil, fmt.Errorf("registry %q: %w", rc.Host, err)
+			}
+		}
+		hosts = append(hosts, host)
+		regs = append(regs, registry{
+			host:     rc.Host,
+			endpoint: rc.Endpoint,
+			gc:       rc.GC,
+			exec:     rc.Exec,
+		})
+	}
+	return regs, hosts, nil
+}
+
+func parseTLS(mode string) (config.TLSConf, error) {
+	switch mode {
+	case "", "enabled":
+		return config.TLSEnabled, nil
+	case "disabled":
+		return config.TLSDisabled, nil
+	case "insecure":
+		return config.TLSInsecure, nil
+	default:
+		return config.TLSUndefined, fmt.Errorf("unknown tls mode %q", mode)
+	}
+}
+
+// applyAuth resolves auth's credentials and sets them on host.
+func applyAuth(ctx context.Context, host *config.Host, extHost string, auth *RegistryAuth) error {
+	switch {
+	case auth.Basic != nil:
+		pass := auth.Basic.Password
+		if auth.Basic.PasswordSecret != nil {
+			p, err := readSecretKey(ctx, auth.Basic.PasswordSecret, "password")
+			if err != nil {
+				return err
+			}
+			pass = p
+		}
+		host.User = auth.Basic.Username
+		host.Pass = pass
+	case auth.Bearer != "":
+		host.Token = auth.Bearer
+	case auth.DockerConfigSecret != nil:
+		user, pass, err := dockerConfigAuth(ctx, auth.DockerConfigSecret, extHost)
+		if err != nil {
+			return err
+		}
+		host.User = user
+		host.Pass = pass
+	}
+	return nil
+}
+
+// readSecretKey returns the value of ref.Key in the Secret ref points at,
+// falling back to key if ref.Key is empty.
+func readSecretKey(ctx context.Context, ref *SecretRef, key string) (string, error) {
+	if ref.Key != "" {
+		key = ref.Key
+	}
+	secret, err := k8s.CoreV1().Secrets(ref.Namespace).Get(
+		ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("could not get secret %s/%s: %w",
+			ref.Namespace, ref.Name, err)
+	}
+	v, ok := secret.Data[key]
+	if !ok {
+		return "", fmt.Errorf("secret %s/%s has no key %q",
+			ref.Namespace, ref.Name, key)
+	}
+	return string(v), nil
+}
+
+// dockerConfigEntry mirrors the per-host entry in a docker config JSON's
+// "auths" map.
+type dockerConfigEntry struct {
+	Auth string `json:"auth"`
+}
+
+// dockerConfigAuth reads a kubernetes.io/dockerconfigjson Secret and
+// returns the username and password configured for host.
+func dockerConfigAuth(ctx context.Context, ref *SecretRef, host string) (user, pass string, err error) {
+	key := ref.Key
+	if key == "" {
+		key = ".dockerconfigjson"
+	}
+	secret, err := k8s.CoreV1().Secrets(ref.Namespace).Get(
+		ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", "", fmt.Errorf("could not get secret %s/%s: %w",
+			ref.Namespace, ref.Name, err)
+	}
+	raw, ok := secret.Data[key]
+	if !ok {
+		return "", "", fmt.Errorf("secret %s/%s has no key %q",
+			ref.Namespace, ref.Name, key)
+	}
+	var dockerCfg struct {
+		Auths map[string]dockerConfigEntry `json:"auths"`
+	}
+	if err := json.Unmarshal(raw, &dockerCfg); err != nil {
+		return "", "", fmt.Errorf("could not parse docker config in secret %s/%s: %w",
+			ref.Namespace, ref.Name, err)
+	}
+	entry, ok := dockerCfg.Auths[host]
+	if !ok {
+		return "", "", fmt.Errorf(
+			"secret %s/%s has no auth entry for %q", ref.Namespace, ref.Name, host)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+	if err != nil {
+		return "", "", fmt.Errorf("could not decode auth for %q: %w", host, err)
+	}
+	user, pass, ok = strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", "", fmt.Errorf("malformed auth for %q", host)
+	}
+	return user, pass, nil
+}
@@ -4,16 +4,16 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
-	"strings"
+	"os"
 	"time"
 
 	"github.com/regclient/regclient"
-	"github.com/regclient/regclient/config"
+	"github.com/regclient/regclient/types/manifest"
 	"github.com/regclient/regclient/types/ref"
 	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/httpstream"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
@@ -23,136 +23,456 @@ import (
 
 type stringset = map[string]struct{}
 
-func main() {
-	ticker := time.NewTicker(time.Hour)
-	for ; true; <-ticker.C {
-		if err := run(); err != nil {
-			slog.Error(err.Error())
-		}
+// imageCreatedAnnotation is the OCI annotation holding an image's build time.
+const imageCreatedAnnotation = "org.opencontainers.image.created"
+
+// envDuration returns the duration held in the named environment variable,
+// or def if it is unset or invalid.
+func envDuration(name string, def time.Duration) time.Duration {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def
 	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		slog.Warn("could not parse duration from environment",
+			"var", name, "value", v, "err", err)
+		return def
+	}
+	return d
 }
 
 var (
 	rc   *regclient.RegClient
 	k8s  *kubernetes.Clientset
 	rcfg *rest.Config
+
+	// registries are the configured registry targets, resolved at
+	// startup from the config file.
+	registries []registry
+
+	// graceperiod is the minimum age an image's newest ancestor must have
+	// before the image is considered for deletion. This protects images
+	// that have been pushed but not yet rolled out to any pod.
+	graceperiod time.Duration
+
+	// dryRun, when set, makes deleteImage and gcRegistry log and record
+	// what they would do without mutating the registry.
+	dryRun bool
 )
 
-func run() error {
-	rc = regclient.New(
-		regclient.WithConfigHost(
-			config.Host{Name: "registry:5000", TLS: config.TLSDisabled},
-		),
-	)
-	var err error
-	rcfg, err = rest.InClusterConfig()
-	if err != nil {
-		return fmt.Errorf("could not get cluster config: %w", err)
-	}
-	k8s, err = kubernetes.NewForConfig(rcfg)
-	if err != nil {
-		return fmt.Errorf("could not make kubernetes client: %w", err)
+// run compares every configured registry's tags against reftags and
+// refdigests, the referenced-image sets maintained by runReconciler, and
+// deletes anything no longer referenced. Images are matched within their
+// own registry, keyed by external hostname, so a reference into one
+// registry never protects an image in another. A failure scanning or
+// cleaning up one registry is recorded and does not stop the others from
+// being processed.
+func run(ctx context.Context, reftags, refdigests stringset) error {
+	var errs []error
+	for _, reg := range registries {
+		if err := runRegistry(ctx, reg, reftags, refdigests); err != nil {
+			errs = append(errs, err)
+		}
 	}
+	return errors.Join(errs...)
+}
 
-	regimgs, err := fetchRegistryImages()
-	if err != nil {
-		return fmt.Errorf("could not fetch registry images: %w", err)
-	}
-	podimgs, err := fetchPodImages()
+// runRegistry cleans up a single registry: it deletes every unreferenced
+// tag, then runs the registry's configured gc step.
+func runRegistry(ctx context.Context, reg registry, reftags, refdigests stringset) error {
+	regimgs, err := fetchRegistryImages(ctx, reg)
 	if err != nil {
-		return fmt.Errorf("could not fetch pod images: %w", err)
+		errorsTotal.WithLabelValues(reg.host, "scan").Inc()
+		return fmt.Errorf(
+			"could not fetch images for registry %q: %w", reg.host, err)
 	}
-	for img := range regimgs {
-		if _, ok := podimgs[img]; ok {
-			delete(regimgs, img)
+	retained := retainedManifests(ctx, reg, regimgs, reftags, refdigests)
+	for _, ri := range regimgs {
+		imagesScanned.WithLabelValues(reg.host).Inc()
+		if _, ok := reftags[ri.tagKey]; ok {
+			continue
 		}
-	}
-	for img := range regimgs {
-		if err := deleteImage(img); err != nil {
-			return fmt.Errorf("could not delete image %q: %w", img, err)
+		if _, ok := refdigests[ri.digestKey]; ok {
+			continue
+		}
+		key := ri.repo + "@" + ri.digest
+		retained.counts[key]--
+		lastRef := retained.counts[key] <= 0
+		if err := deleteImage(ctx, reg, ri.repo, ri.tag, lastRef, retained); err != nil {
+			errorsTotal.WithLabelValues(reg.host, "delete").Inc()
+			return fmt.Errorf("could not delete image %q: %w", ri.tagKey, err)
 		}
 	}
-	if err := gcRegistry(); err != nil {
-		return fmt.Errorf("could not trigger registry gc: %w", err)
+	start := time.Now()
+	err = gcRegistry(ctx, reg)
+	gcDuration.WithLabelValues(reg.host).Observe(time.Since(start).Seconds())
+	if err != nil {
+		errorsTotal.WithLabelValues(reg.host, "gc").Inc()
+		return fmt.Errorf(
+			"could not trigger gc for registry %q: %w", reg.host, err)
 	}
 	return nil
 }
 
-func fetchRegistryImages() (stringset, error) {
-	// TODO: Also ignore recent uploads here, if possible.
-	// Manifests may have timestamps and could be used for a grace period.
-	imgs := make(stringset)
-	repos, err := rc.RepoList(context.Background(), "registry:5000")
+// retainedState holds the manifests and layer blobs that deleteImage must
+// not remove even though the particular tag it was asked to delete is
+// unreferenced, because something else in the same repository still
+// depends on them.
+type retainedState struct {
+	// counts holds, per "repo@digest", the number of tags in regimgs that
+	// still point at it: both tags kept because they're referenced, and
+	// tags not yet processed by runRegistry's deletion loop. runRegistry
+	// decrements a digest's count as each of its unreferenced tags is
+	// deleted; deleteImage only removes the manifest and its layers once
+	// the count reaches zero, so two simultaneously-unreferenced tags
+	// sharing a digest (an orphaned "latest" alongside an orphaned
+	// version tag, say) don't race the manifest out from under each
+	// other. A digest with any referenced tag never reaches zero, since
+	// runRegistry skips referenced tags without decrementing.
+	counts map[string]int
+	// layers maps repo to the set of layer digests used by any of that
+	// repo's surviving (referenced) manifests, so a blob shared with a
+	// base image that is still in use is never deleted.
+	layers map[string]stringset
+}
+
+// retainedManifests counts, per "repo@digest", how many tags in regimgs
+// point at it, and separately resolves the layers used by every
+// surviving (referenced) manifest. Errors resolving an individual
+// surviving manifest are logged and treated conservatively: its layers
+// are simply not added to the retained set, which can only cause a blob
+// delete to be skipped, never performed in error.
+func retainedManifests(
+	ctx context.Context, reg registry, regimgs []registryImage, reftags, refdigests stringset,
+) *retainedState {
+	ret := &retainedState{
+		counts: make(map[string]int),
+		layers: make(map[string]stringset),
+	}
+	seen := make(stringset)
+	for _, ri := range regimgs {
+		key := ri.repo + "@" + ri.digest
+		ret.counts[key]++
+
+		_, keptTag := reftags[ri.tagKey]
+		_, keptDigest := refdigests[ri.digestKey]
+		if !keptTag && !keptDigest {
+			continue
+		}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+
+		r := ref.Ref{
+			Registry: reg.endpoint, Repository: ri.repo,
+			Digest: ri.digest, Scheme: "reg",
+		}
+		m, err := rc.ManifestGet(ctx, r)
+		if err != nil {
+			slog.Warn("could not get manifest to compute retained layers",
+				"repo", ri.repo, "digest", ri.digest, "err", err)
+			continue
+		}
+		img, ok := m.(manifest.Imager)
+		if !ok {
+			continue
+		}
+		layers, err := img.GetLayers()
+		if err != nil {
+			slog.Warn("could not get layers to compute retained layers",
+				"repo", ri.repo, "digest", ri.digest, "err", err)
+			continue
+		}
+		if ret.layers[ri.repo] == nil {
+			ret.layers[ri.repo] = make(stringset)
+		}
+		for _, layer := range layers {
+			ret.layers[ri.repo][layer.Digest.String()] = struct{}{}
+		}
+	}
+	return ret
+}
+
+// registryImage is a single tag discovered in a registry, resolved to the
+// manifest digest it currently points at.
+type registryImage struct {
+	repo      string
+	tag       string
+	digest    string
+	tagKey    string // e.g. "ctr.example.com/repo:tag", for matching against workloads
+	digestKey string // e.g. "ctr.example.com@sha256:...", for matching against workloads
+}
+
+func fetchRegistryImages(ctx context.Context, reg registry) ([]registryImage, error) {
+	var imgs []registryImage
+	// created caches a manifest digest's resolved creation time so a
+	// manifest referenced by multiple tags is only fetched once per run.
+	created := make(map[string]time.Time)
+
+	repos, err := rc.RepoList(ctx, reg.endpoint)
 	if err != nil {
 		return nil, fmt.Errorf("could not get repository list: %w", err)
 	}
 	for _, repo := range repos.RepoRegistryList.Repositories {
-		tags, err := rc.TagList(context.Background(), ref.Ref{
+		tags, err := rc.TagList(ctx, ref.Ref{
 			Scheme:     "reg",
 			Repository: repo,
-			Registry:   "registry:5000",
+			Registry:   reg.endpoint,
 		})
 		if err != nil {
 			return nil, fmt.Errorf("could not get tags for repository %q: %w",
 				repo, err)
 		}
 		for _, tag := range tags.Tags {
-			imgs["ctr.lesiw.dev/"+repo+":"+tag] = struct{}{}
+			r := ref.Ref{
+				Scheme:     "reg",
+				Registry:   reg.endpoint,
+				Repository: repo,
+				Tag:        tag,
+			}
+			digest, recent, err := inspectImage(ctx, r, created)
+			if err != nil {
+				return nil, fmt.Errorf(
+					"could not inspect %q:%q: %w", repo, tag, err)
+			}
+			if recent {
+				continue
+			}
+			imgs = append(imgs, registryImage{
+				repo:      repo,
+				tag:       tag,
+				digest:    digest,
+				tagKey:    reg.host + "/" + repo + ":" + tag,
+				digestKey: reg.host + "@" + digest,
+			})
 		}
 	}
 	return imgs, nil
 }
 
-func fetchPodImages() (stringset, error) {
-	imgs := make(stringset)
-	pods, err := k8s.CoreV1().Pods("").List(
-		context.Background(), metav1.ListOptions{})
+// inspectImage returns r's manifest digest and whether its newest ancestor
+// is younger than [graceperiod], caching creation timestamps in seen by
+// manifest digest so that tags sharing a manifest only have its creation
+// time fetched once; every tag still costs one manifest HEAD. If r's creation time cannot be determined (for
+// example a manifest list with no image config to inspect), inspectImage
+// logs a warning and conservatively reports the image as recent rather
+// than failing the scan of every other tag in the registry.
+func inspectImage(
+	ctx context.Context, r ref.Ref, seen map[string]time.Time,
+) (digest string, recent bool, err error) {
+	head, err := rc.ManifestHead(ctx, r)
 	if err != nil {
-		return nil, err
+		return "", false, fmt.Errorf("could not head manifest: %w", err)
 	}
-	for _, pod := range pods.Items {
-		for _, ctr := range pod.Spec.Containers {
-			imgs[ctr.Image] = struct{}{}
+	digest = head.GetDescriptor().Digest.String()
+	t, ok := seen[digest]
+	if !ok {
+		t, err = manifestCreated(ctx, r)
+		if err != nil {
+			slog.Warn("could not determine image creation time, "+
+				"treating as protected", "ref", r.CommonName(), "err", err)
+			return digest, true, nil
 		}
+		seen[digest] = t
 	}
-	return imgs, nil
+	return digest, time.Since(t) < graceperiod, nil
 }
 
-func deleteImage(img string) error {
-	_, repotag, ok := strings.Cut(img, "/")
-	if !ok {
-		return fmt.Errorf("could not parse registry from %q", img)
+// manifestCreated resolves the creation timestamp of the image at r,
+// preferring the OCI "created" annotation, falling back to the config
+// blob's created field, and finally the newest entry in the config's
+// history.
+func manifestCreated(ctx context.Context, r ref.Ref) (time.Time, error) {
+	m, err := rc.ManifestGet(ctx, r)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not get manifest: %w", err)
+	}
+	if ma, ok := m.(manifest.Annotator); ok {
+		if annot, err := ma.GetAnnotations(); err == nil {
+			if v, ok := annot[imageCreatedAnnotation]; ok {
+				if t, err := time.Parse(time.RFC3339, v); err == nil {
+					return t, nil
+				}
+			}
+		}
 	}
-	repo, tag, ok := strings.Cut(repotag, ":")
+	mi, ok := m.(manifest.Imager)
 	if !ok {
-		return fmt.Errorf("could not parse repo and tag from %q", repotag)
-	}
-	err := rc.TagDelete(context.Background(), ref.Ref{
-		Registry:   "registry:5000",
-		Repository: repo,
-		Tag:        tag,
-		Scheme:     "reg",
-	})
+		return time.Time{}, fmt.Errorf("manifest %s has no image config", r.CommonName())
+	}
+	confDesc, err := mi.GetConfig()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not get config descriptor: %w", err)
+	}
+	conf, err := rc.BlobGetOCIConfig(ctx, r, confDesc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not get config blob: %w", err)
+	}
+	img := conf.GetConfig()
+	if img.Created != nil {
+		return *img.Created, nil
+	}
+	for i := len(img.History) - 1; i >= 0; i-- {
+		if img.History[i].Created != nil {
+			return *img.History[i].Created, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("no created timestamp for %s", r.CommonName())
+}
+
+// imagesFromSpec normalizes every init, regular, and ephemeral container
+// image in spec through ref.New, returning the set of referenced
+// host/repo:tag pairs and the set of referenced host@digest manifests, so
+// an image pinned by digest is matched even if its tag has since moved on.
+// Keys are scoped by the image's registry hostname to match
+// fetchRegistryImages' grouping. It is used by runReconciler's imageTracker
+// to extract images from watched workloads.
+func imagesFromSpec(spec corev1.PodSpec) (tags, digests stringset) {
+	tags = make(stringset)
+	digests = make(stringset)
+
+	add := func(image string) {
+		r, err := ref.New(image)
+		if err != nil {
+			slog.Warn("could not parse image reference",
+				"image", image, "err", err)
+			return
+		}
+		if r.Digest != "" {
+			digests[r.Registry+"@"+r.Digest] = struct{}{}
+		}
+		if r.Tag != "" {
+			tags[r.Registry+"/"+r.Repository+":"+r.Tag] = struct{}{}
+		}
+	}
+	for _, c := range spec.InitContainers {
+		add(c.Image)
+	}
+	for _, c := range spec.Containers {
+		add(c.Image)
+	}
+	for _, c := range spec.EphemeralContainers {
+		add(c.Image)
+	}
+	return tags, digests
+}
+
+// deleteImage removes repo:tag from reg. lastRef reports whether this is
+// the last tag in the repo still pointing at the manifest, per retained's
+// counts; only then does deleteImage also remove the manifest by digest
+// and, where the registry allows it, the layer blobs no surviving
+// manifest in the repo still depends on. Blob deletes are best-effort:
+// many registries reject them outright, relying instead on an offline
+// sweep (see gcRegistry). In dry-run mode, no registry state is mutated;
+// deleteImage only resolves the manifest to produce an accurate audit
+// record.
+func deleteImage(
+	ctx context.Context, reg registry, repo, tag string, lastRef bool, retained *retainedState,
+) error {
+	r := ref.Ref{Registry: reg.endpoint, Repository: repo, Tag: tag, Scheme: "reg"}
+	m, err := rc.ManifestGet(ctx, r)
 	if err != nil {
-		return fmt.Errorf("could not delete %q: %w", img, err)
+		return fmt.Errorf("could not get manifest for %q:%q: %w", repo, tag, err)
+	}
+	digest := m.GetDescriptor().Digest.String()
+	var size int64
+	if img, ok := m.(manifest.Imager); ok {
+		if layers, err := img.GetLayers(); err != nil {
+			slog.Warn("could not get layers", "repo", repo, "tag", tag, "err", err)
+		} else {
+			for _, layer := range layers {
+				size += layer.Size
+			}
+		}
+	}
+
+	if dryRun {
+		if !lastRef {
+			size = 0
+		}
+		recordDeletion(ctx, reg, repo, tag, digest, size, true)
+		return nil
+	}
+
+	if err := rc.TagDelete(ctx, r); err != nil {
+		return fmt.Errorf("could not delete tag %q:%q: %w", repo, tag, err)
+	}
+
+	if !lastRef {
+		slog.Info("manifest still referenced by another tag, keeping",
+			"registry", reg.host, "repo", repo, "digest", digest)
+		recordDeletion(ctx, reg, repo, tag, digest, 0, false)
+		return nil
+	}
+
+	digestRef := r
+	digestRef.Tag = ""
+	digestRef.Digest = digest
+	if err := rc.ManifestDelete(ctx, digestRef); err != nil {
+		slog.Warn("could not delete manifest", "repo", repo, "tag", tag, "err", err)
 	}
-	slog.Info("deleted image", "image", img)
+	if img, ok := m.(manifest.Imager); ok {
+		layers, err := img.GetLayers()
+		if err != nil {
+			slog.Warn("could not get layers", "repo", repo, "tag", tag, "err", err)
+		}
+		for _, layer := range layers {
+			if _, ok := retained.layers[repo][layer.Digest.String()]; ok {
+				continue
+			}
+			layerRef := digestRef
+			layerRef.Digest = layer.Digest.String()
+			if err := rc.BlobDelete(ctx, layerRef, layer); err != nil {
+				slog.Debug("could not delete blob",
+					"repo", repo, "digest", layer.Digest.String(), "err", err)
+			}
+		}
+	}
+
+	recordDeletion(ctx, reg, repo, tag, digest, size, false)
 	return nil
 }
 
-func gcRegistry() error {
+// gcRegistry runs a registry's configured maintenance step. deleteImage
+// already removes manifests and, where supported, blobs through the
+// registry API, so by default there is nothing further to do. Registries
+// that need the offline distribution/registry sweep instead set gc: exec
+// and an exec target.
+func gcRegistry(ctx context.Context, reg registry) error {
+	switch reg.gc {
+	case "", "api":
+		return nil
+	case "exec":
+		return execRegistryGC(ctx, reg)
+	default:
+		return fmt.Errorf("unknown gc mode %q for registry %q", reg.gc, reg.host)
+	}
+}
+
+// execRegistryGC triggers the distribution/registry offline sweep by
+// exec'ing reg's configured command in its designated pod. In dry-run
+// mode it only logs the command that would have been run.
+func execRegistryGC(ctx context.Context, reg registry) error {
+	if reg.exec == nil {
+		return fmt.Errorf("registry %q: gc: exec requires an exec target", reg.host)
+	}
+	if dryRun {
+		slog.Info("audit: would exec registry gc", "registry", reg.host,
+			"pod", reg.exec.Pod, "namespace", reg.exec.Namespace,
+			"command", reg.exec.Command, "dry_run", true)
+		return nil
+	}
 	req := k8s.CoreV1().RESTClient().Post().
 		Resource("pods").
-		Name("registry-0").
-		Namespace("default").
+		Name(reg.exec.Pod).
+		Namespace(reg.exec.Namespace).
 		SubResource("exec")
 	req.VersionedParams(&corev1.PodExecOptions{
-		Command: []string{
-			"bin/registry", "garbage-collect", "--delete-untagged",
-			"/etc/docker/registry/config.yml",
-		},
-		Stdout: true,
-		Stderr: true,
+		Command: reg.exec.Command,
+		Stdout:  true,
+		Stderr:  true,
 	}, scheme.ParameterCodec)
 
 	spdyExec, err := remotecommand.NewSPDYExecutor(rcfg, "POST", req.URL())
@@ -171,7 +491,7 @@ func gcRegistry() error {
 		},
 	)
 	var buf bytes.Buffer
-	err = exec.StreamWithContext(context.Background(),
+	err = exec.StreamWithContext(ctx,
 		remotecommand.StreamOptions{
 			Stdout: &buf,
 			Stderr: &buf,
@@ -185,6 +505,6 @@ func gcRegistry() error {
 	} else if err != nil {
 		return fmt.Errorf("could not exec registry garbage-collect: %w", err)
 	}
-	slog.Info("gc completed")
+	slog.Info("gc completed", "registry", reg.host)
 	return nil
 }
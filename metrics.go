@@ -0,0 +1,49 @@
+// metrics.go exposes reggc's Prometheus metrics, served on /metrics
+// alongside the /healthz and /readyz endpoints in reconciler.go.
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// imagesScanned counts every registry tag considered for deletion,
+	// whether or not it turned out to be referenced.
+	imagesScanned = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "reggc_images_scanned_total",
+		Help: "Registry tags considered for deletion, by registry.",
+	}, []string{"registry"})
+
+	// imagesDeleted counts tags actually removed. In dry-run mode this
+	// counts tags that would have been removed.
+	imagesDeleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "reggc_images_deleted_total",
+		Help: "Registry tags deleted, by registry.",
+	}, []string{"registry", "dry_run"})
+
+	// bytesReclaimed sums the compressed size of the layers belonging to
+	// deleted manifests, as reported by deleteImage. It is only an
+	// approximation of space actually freed: a layer shared with a
+	// surviving tag is counted here even though the registry keeps it on
+	// disk, and manifest-list images, which have no single layer set,
+	// contribute zero.
+	bytesReclaimed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "reggc_bytes_reclaimed_total",
+		Help: "Approximate bytes of deleted image layers, by registry.",
+	}, []string{"registry", "dry_run"})
+
+	// gcDuration times each registry's gcRegistry call, including the
+	// exec fallback where configured.
+	gcDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "reggc_gc_duration_seconds",
+		Help: "Time spent running a registry's gc step.",
+	}, []string{"registry"})
+
+	// errorsTotal counts failures encountered while scanning or cleaning
+	// up a registry, by registry and the stage that failed.
+	errorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "reggc_errors_total",
+		Help: "Errors encountered while scanning or cleaning up a registry.",
+	}, []string{"registry", "stage"})
+)
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/regclient/regclient"
+	"github.com/regclient/regclient/config"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// debounce is the quiet period after the last informer event before a
+// cleanup pass runs, so a burst of pod churn coalesces into one run().
+var debounce time.Duration
+
+// resync is how often the informer caches are relisted, and doubles as
+// the upper bound between cleanup passes when nothing else changes.
+var resync time.Duration
+
+// ready reports whether the informer caches have completed their initial
+// sync. It backs the /readyz endpoint.
+var ready = make(chan struct{})
+
+func main() {
+	flag.DurationVar(&graceperiod, "grace-period", envDuration("GRACE_PERIOD", time.Hour),
+		"minimum age of an image before it is eligible for deletion")
+	flag.DurationVar(&debounce, "debounce", envDuration("DEBOUNCE", 10*time.Second),
+		"quiet period after the last workload change before running cleanup")
+	flag.DurationVar(&resync, "resync", envDuration("RESYNC", time.Hour),
+		"informer resync period, and upper bound between cleanup passes")
+	addr := flag.String("http-addr", envString("HTTP_ADDR", ":8080"),
+		"address to serve /healthz, /readyz, and /metrics on")
+	configPath := flag.String("config", envString("CONFIG_FILE", "/etc/reggc/config.yml"),
+		"path to the registry configuration file")
+	flag.BoolVar(&dryRun, "dry-run", envBool("DRY_RUN", false),
+		"log what would be deleted without mutating any registry")
+	flag.Parse()
+
+	go serveHTTP(*addr)
+
+	var err error
+	rcfg, err = rest.InClusterConfig()
+	if err != nil {
+		slog.Error("could not get cluster config", "err", err)
+		os.Exit(1)
+	}
+	k8s, err = kubernetes.NewForConfig(rcfg)
+	if err != nil {
+		slog.Error("could not make kubernetes client", "err", err)
+		os.Exit(1)
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		slog.Error("could not load config", "err", err)
+		os.Exit(1)
+	}
+	var hosts []config.Host
+	registries, hosts, err = resolveRegistries(context.Background(), cfg)
+	if err != nil {
+		slog.Error("could not resolve registries", "err", err)
+		os.Exit(1)
+	}
+	rc = regclient.New(regclient.WithConfigHosts(hosts))
+	auditEvent = cfg.AuditEvent
+
+	if dryRun {
+		slog.Info("dry-run mode enabled: no registry state will be mutated")
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "reggc"
+	}
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      "reggc",
+			Namespace: "default",
+		},
+		Client: k8s.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: hostname,
+		},
+	}
+	ctx := context.Background()
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		ReleaseOnCancel: true,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: runReconciler,
+			OnStoppedLeading: func() {
+				slog.Info("lost leadership, exiting")
+				os.Exit(1)
+			},
+		},
+	})
+}
+
+// envString returns the string held in the named environment variable, or
+// def if it is unset.
+func envString(name, def string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return def
+}
+
+// envBool returns the boolean held in the named environment variable, or
+// def if it is unset or invalid.
+func envBool(name string, def bool) bool {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		slog.Warn("could not parse bool from environment",
+			"var", name, "value", v, "err", err)
+		return def
+	}
+	return b
+}
+
+func serveHTTP(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-ready:
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.Handle("/metrics", promhttp.Handler())
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("http server exited", "err", err)
+	}
+}
+
+// runReconciler drives cleanup from an informer-maintained view of live
+// image references instead of polling the API server on a fixed ticker.
+// It runs a debounced cleanup pass whenever the referenced-image set
+// changes, with resync as a fallback upper bound between passes.
+func runReconciler(ctx context.Context) {
+	tracker := newImageTracker()
+	factory := informers.NewSharedInformerFactory(k8s, resync)
+
+	trigger := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj any) {
+			tracker.add(obj)
+			notify()
+		},
+		UpdateFunc: func(oldObj, newObj any) {
+			if tracker.update(oldObj, newObj) {
+				notify()
+			}
+		},
+		DeleteFunc: func(obj any) {
+			tracker.remove(obj)
+			notify()
+		},
+	}
+
+	infs := []cache.SharedIndexInformer{
+		factory.Core().V1().Pods().Informer(),
+		factory.Apps().V1().Deployments().Informer(),
+		factory.Apps().V1().StatefulSets().Informer(),
+		factory.Apps().V1().DaemonSets().Informer(),
+		factory.Apps().V1().ReplicaSets().Informer(),
+		factory.Batch().V1().Jobs().Informer(),
+		factory.Batch().V1().CronJobs().Informer(),
+	}
+	for _, inf := range infs {
+		if _, err := inf.AddEventHandler(handler); err != nil {
+			slog.Error("could not register event handler", "err", err)
+			return
+		}
+	}
+
+	stop := ctx.Done()
+	factory.Start(stop)
+	if !cache.WaitForCacheSync(stop, informerSyncFuncs(infs)...) {
+		slog.Error("informer caches failed to sync")
+		return
+	}
+	close(ready)
+	slog.Info("informer caches synced")
+
+	reconcile := func() {
+		reftags, refdigests := tracker.snapshot()
+		if err := run(ctx, reftags, refdigests); err != nil {
+			slog.Error(err.Error())
+		}
+	}
+
+	resyncTimer := time.NewTimer(resync)
+	defer resyncTimer.Stop()
+	var debounceTimer *time.Timer
+	var debounceC <-chan time.Time
+	for {
+		select {
+		case <-trigger:
+			if debounceTimer != nil {
+				debounceTimer.Stop()
+			}
+			debounceTimer = time.NewTimer(debounce)
+			debounceC = debounceTimer.C
+		case <-debounceC:
+			debounceC = nil
+			resyncTimer.Reset(resync)
+			reconcile()
+		case <-resyncTimer.C:
+			resyncTimer.Reset(resync)
+			reconcile()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func informerSyncFuncs(infs []cache.SharedIndexInformer) []cache.InformerSynced {
+	synced := make([]cache.InformerSynced, len(infs))
+	for i, inf := range infs {
+		synced[i] = inf.HasSynced
+	}
+	return synced
+}
+
+// imageTracker maintains a refcounted view of every image reference held
+// by live and scaled-down workloads, so the set can be updated
+// incrementally from informer events instead of re-listing the cluster.
+type imageTracker struct {
+	mu         sync.Mutex
+	tagRefs    map[string]int
+	digestRefs map[string]int
+}
+
+func newImageTracker() *imageTracker {
+	return &imageTracker{
+		tagRefs:    make(map[string]int),
+		digestRefs: make(map[string]int),
+	}
+}
+
+// add increments the refcount of every image referenced by obj.
+func (t *imageTracker) add(obj any) {
+	tags, digests := extractImages(obj)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for tag := range tags {
+		t.tagRefs[tag]++
+	}
+	for digest := range digests {
+		t.digestRefs[digest]++
+	}
+}
+
+// remove decrements the refcount of every image referenced by obj,
+// dropping entries that reach zero.
+func (t *imageTracker) remove(obj any) {
+	tags, digests := extractImages(obj)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for tag := range tags {
+		if t.tagRefs[tag]--; t.tagRefs[tag] <= 0 {
+			delete(t.tagRefs, tag)
+		}
+	}
+	for digest := range digests {
+		if t.digestRefs[digest]--; t.digestRefs[digest] <= 0 {
+			delete(t.digestRefs, digest)
+		}
+	}
+}
+
+// update reconciles a resource version change, returning whether the set
+// of referenced images actually changed.
+func (t *imageTracker) update(oldObj, newObj any) bool {
+	oldTags, oldDigests := extractImages(oldObj)
+	newTags, newDigests := extractImages(newObj)
+	if stringsetEqual(oldTags, newTags) && stringsetEqual(oldDigests, newDigests) {
+		return false
+	}
+	t.remove(oldObj)
+	t.add(newObj)
+	return true
+}
+
+// snapshot returns a point-in-time copy of the referenced tag and digest
+// sets, suitable for passing to run().
+func (t *imageTracker) snapshot() (tags, digests stringset) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tags = make(stringset, len(t.tagRefs))
+	for tag := range t.tagRefs {
+		tags[tag] = struct{}{}
+	}
+	digests = make(stringset, len(t.digestRefs))
+	for digest := range t.digestRefs {
+		digests[digest] = struct{}{}
+	}
+	return tags, digests
+}
+
+func stringsetEqual(a, b stringset) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if _, ok := b[k]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// extractImages returns the referenced repo:tag pairs and manifest digests
+// for the PodSpec embedded in obj, which must be one of the workload types
+// watched by runReconciler.
+func extractImages(obj any) (tags, digests stringset) {
+	var spec corev1.PodSpec
+	switch o := obj.(type) {
+	case *corev1.Pod:
+		spec = o.Spec
+	case *appsv1.Deployment:
+		spec = o.Spec.Template.Spec
+	case *appsv1.StatefulSet:
+		spec = o.Spec.Template.Spec
+	case *appsv1.DaemonSet:
+		spec = o.Spec.Template.Spec
+	case *appsv1.ReplicaSet:
+		spec = o.Spec.Template.Spec
+	case *batchv1.Job:
+		spec = o.Spec.Template.Spec
+	case *batchv1.CronJob:
+		spec = o.Spec.JobTemplate.Spec.Template.Spec
+	case cache.DeletedFinalStateUnknown:
+		return extractImages(o.Obj)
+	default:
+		return make(stringset), make(stringset)
+	}
+	return imagesFromSpec(spec)
+}